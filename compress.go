@@ -0,0 +1,82 @@
+package tcpmux
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// cmdDataLZ4 (defined in protocol.go) marks a data frame whose payload
+// was LZ4-compressed by the sender. It is only ever sent once both
+// peers advertised featureCompressLZ4 during the version handshake (see
+// version.go). The frame is followed by a 4-byte compressed length and
+// then the compressed bytes, which themselves start with a 4-byte
+// big-endian uncompressed length.
+
+// compressThreshold is the smallest payload tcpmux will bother to
+// compress; below it the framing overhead isn't worth the CPU.
+const compressThreshold = 1024
+
+// MaxDecompressedSize caps how large a single LZ4 frame may expand to,
+// guarding against decompression-bomb payloads from a malicious peer.
+var MaxDecompressedSize = 16 * 1024 * 1024
+
+var errDecompressionBomb = errors.New("tcpmux: decompressed frame exceeds MaxDecompressedSize")
+
+// ErrCompressionNotNegotiated is broadcast if a peer sends a cmdDataLZ4
+// frame without both sides having agreed to featureCompressLZ4 during
+// the version handshake.
+var ErrCompressionNotNegotiated = errors.New("tcpmux: cmdDataLZ4 received without negotiated compression")
+
+// maybeCompress LZ4-compresses src if it is worth it, returning the
+// encoded frame payload (4-byte uncompressed length + compressed bytes)
+// and true, or (nil, false) if src should be sent uncompressed instead.
+func maybeCompress(src []byte) ([]byte, bool) {
+	if len(src) < compressThreshold {
+		return nil, false
+	}
+
+	buf := make([]byte, 4+lz4.CompressBlockBound(len(src)))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(src)))
+
+	var c lz4.Compressor
+	n, err := c.CompressBlock(src, buf[4:])
+	if err != nil || n == 0 || 4+n >= len(src) {
+		// Not compressible, or compression didn't meaningfully shrink it.
+		return nil, false
+	}
+
+	return buf[:4+n], true
+}
+
+// decodedLen reads the 4-byte uncompressed-length prefix off a framed LZ4
+// payload without decompressing it, so callers can check it against a
+// receive window or MaxDecompressedSize before allocating anything.
+func decodedLen(framed []byte) (uint32, error) {
+	if len(framed) < 4 {
+		return 0, errors.New("tcpmux: truncated LZ4 frame")
+	}
+
+	return binary.BigEndian.Uint32(framed[:4]), nil
+}
+
+// decompress reverses maybeCompress, enforcing MaxDecompressedSize.
+func decompress(framed []byte) ([]byte, error) {
+	n, err := decodedLen(framed)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > uint32(MaxDecompressedSize) {
+		return nil, errDecompressionBomb
+	}
+
+	dst := make([]byte, n)
+	written, err := lz4.UncompressBlock(framed[4:], dst)
+	if err != nil {
+		return nil, err
+	}
+
+	return dst[:written], nil
+}
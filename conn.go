@@ -2,7 +2,6 @@ package tcpmux
 
 import (
 	"encoding/binary"
-	"io"
 	"net"
 	"strconv"
 	"sync"
@@ -13,9 +12,20 @@ import (
 type connState struct {
 	conn net.Conn
 
+	// framer is what start() and stop() actually read, write, and close
+	// through. NewMaster sets it to a tcpFramer over conn and
+	// NewMasterWithFramer to the caller's Framer (e.g. a WebSocket
+	// framer); start() builds a tcpFramer from conn only if it is nil.
+	framer Framer
+
 	master  Map32
 	streams Map32
 
+	// windows holds this conn's per-stream flow-control state (idx ->
+	// *streamWindow; see window.go), populated by newStreamWindowFor
+	// alongside newStreamCallback.
+	windows Map32
+
 	idx uint32
 
 	exitRead chan bool
@@ -25,6 +35,22 @@ type connState struct {
 
 	timeout int64
 	stopped bool
+
+	// maxStreamWindow is the receive window handed to every Stream
+	// accepted or opened on this conn. Zero means defaultStreamWindow.
+	maxStreamWindow uint32
+
+	// Negotiated during the cmdVersion handshake; no stream may be
+	// opened or accepted until handshakeDone is true.
+	handshakeDone     bool
+	negotiatedVersion uint16
+	featureFlags      uint16
+	maxFrameSize      uint32
+
+	// compressionEnabled mirrors MasterConfig.Compression: if false, this
+	// conn never advertises featureCompressLZ4 even if both binaries
+	// support it, for users on already-encrypted or CPU-starved links.
+	compressionEnabled bool
 	sync.Mutex
 }
 
@@ -44,6 +70,10 @@ func (cs *connState) broadcast(err error) {
 }
 
 func (cs *connState) start() {
+	if cs.framer == nil {
+		cs.framer = newTCPFramer(cs.conn)
+	}
+
 	readChan, daemonChan := make(chan bool), make(chan bool)
 
 	go func() {
@@ -61,6 +91,7 @@ func (cs *connState) start() {
 					s := (*Stream)(p)
 					if s.closed.Load().(bool) {
 						// return false to delete
+						cs.windows.Delete(idx)
 						return false
 					}
 
@@ -69,13 +100,28 @@ func (cs *connState) start() {
 						return true
 					}
 
-					s.notifyRead(notifyCancel)
-					s.notifyWrite(notifyCancel)
+					// Tell the peer, rather than silently timing out on our
+					// end while it still thinks the stream is alive.
+					cs.framer.WriteFrame(makeFrame(idx, cmdReset, nil))
+
+					// notifyReset, not notifyCancel: this is a reset, so
+					// Reads/Writes in flight must surface ErrStreamReset.
+					s.notifyRead(notifyReset)
+					s.notifyWrite(notifyReset)
+					cs.windows.Delete(idx)
 					return false
 				})
 
-				// Send ping
-				if _, err := cs.conn.Write(makeFrame(0, cmdPing, nil)); err != nil {
+				// Send ping: prefer a transport-native ping (e.g. a
+				// WebSocket ping frame) when the framer has one, falling
+				// back to writing a cmdPing frame otherwise.
+				var err error
+				if pinger, ok := cs.framer.(Pinger); ok {
+					err = pinger.Ping()
+				} else {
+					err = cs.framer.WriteFrame(makeFrame(0, cmdPing, nil))
+				}
+				if err != nil {
 					cs.broadcast(err)
 					return
 				}
@@ -85,18 +131,19 @@ func (cs *connState) start() {
 
 	for {
 		go func() {
-			buf := make([]byte, 7)
-
 			// Normally we have pings so this deadline shall never be met
 			// cs.conn.SetReadDeadline(time.Now().Add(time.Duration(cs.timeout) * time.Second))
-			_, err := io.ReadAtLeast(cs.conn, buf, 7)
+			header, err := cs.framer.ReadHeader()
+			buf := header[:]
 
 			if err != nil {
 				cs.broadcast(err)
 				return
 			}
 
-			if buf[0] != Version {
+			// Version is a floor, not an exact match, so the wire format can
+			// grow new commands/fields without breaking older peers.
+			if buf[0] < Version {
 				cs.broadcast(ErrInvalidVerHdr)
 				return
 			}
@@ -106,19 +153,161 @@ func (cs *connState) start() {
 
 			if buf[5] == cmdByte && buf[6] != 0 {
 				switch buf[6] {
+				case cmdVersion:
+					// This is the initiator's request: negotiate and send
+					// cmdVersionAck back. We must never reply to a
+					// cmdVersion with another cmdVersion, or two peers
+					// that both dial each other would keep re-replying
+					// forever.
+					payload, err := cs.framer.ReadPayload(versionPayloadLen)
+					if err != nil {
+						cs.broadcast(err)
+						return
+					}
+
+					cs.negotiateVersion(decodeVersionHello(payload))
+
+					reply := versionHello{maxVersion: cs.negotiatedVersion, flags: cs.featureFlags, maxFrameSize: cs.maxFrameSize}
+					if err = cs.framer.WriteFrame(makeFrame(streamIdx, cmdVersionAck, reply.encode())); err != nil {
+						cs.broadcast(err)
+						return
+					}
+
+					readChan <- true
+					return
+				case cmdVersionAck:
+					// This is the acceptor's reply: record it, but never
+					// reply to a reply.
+					payload, err := cs.framer.ReadPayload(versionPayloadLen)
+					if err != nil {
+						cs.broadcast(err)
+						return
+					}
+
+					cs.negotiateVersion(decodeVersionHello(payload))
+
+					readChan <- true
+					return
 				case cmdHello:
+					if !cs.handshakeDone {
+						cs.broadcast(ErrHandshakeRequired)
+						return
+					}
+
 					// The stream will be added into connState in this callback
 					cs.newStreamCallback(&readState{idx: streamIdx})
 
 					buf[5], buf[6] = cmdByte, cmdAck
 					// We acknowledge the hello
-					if _, err = cs.conn.Write(buf); err != nil {
+					if err = cs.framer.WriteFrame(buf); err != nil {
 						cs.broadcast(err)
 						return
 					}
 
 					fallthrough
 				case cmdPing:
+					readChan <- true
+					return
+				case cmdWindowUpdate:
+					// Unlike the other command frames above, cmdWindowUpdate
+					// is followed by a 4-byte payload carrying the delta.
+					delta, err := cs.framer.ReadPayload(4)
+					if err != nil {
+						cs.broadcast(err)
+						return
+					}
+
+					cs.grantSendWindow(streamIdx, binary.BigEndian.Uint32(delta))
+
+					readChan <- true
+					return
+				case cmdDataLZ4:
+					// A peer that never agreed to featureCompressLZ4 has no
+					// business sending compressed frames; treat it as a
+					// protocol violation rather than decoding on trust.
+					if !cs.handshakeDone || cs.featureFlags&featureCompressLZ4 == 0 {
+						cs.broadcast(ErrCompressionNotNegotiated)
+						return
+					}
+
+					// 4 bytes, not 2: compressible payloads up to
+					// maxFrameSize (1 MiB by default) are eligible, and a
+					// barely-compressible one can easily produce a
+					// compressed blob past a uint16's 65535-byte range.
+					lenBuf, err := cs.framer.ReadPayload(4)
+					if err != nil {
+						cs.broadcast(err)
+						return
+					}
+
+					// Bound the claimed compressed size against the same
+					// negotiated maxFrameSize the plain data path enforces
+					// before allocating: otherwise a peer can claim
+					// anything up to 4GiB here and force a giant
+					// allocation before a single byte of it has arrived,
+					// long before reserveRecvWindow/MaxDecompressedSize
+					// ever get a say.
+					compressedLen := binary.BigEndian.Uint32(lenBuf)
+					maxFrameSize := cs.maxFrameSize
+					if maxFrameSize == 0 {
+						maxFrameSize = defaultMaxFrameSize
+					}
+					if compressedLen > maxFrameSize {
+						cs.broadcast(ErrFrameTooLarge)
+						return
+					}
+
+					compressed, err := cs.framer.ReadPayload(int(compressedLen))
+					if err != nil {
+						cs.broadcast(err)
+						return
+					}
+
+					uncompressedLen, lerr := decodedLen(compressed)
+					if lerr != nil {
+						cs.broadcast(lerr)
+						return
+					}
+
+					p, ok := cs.streams.Load(streamIdx)
+					if !ok {
+						readChan <- true
+						return
+					}
+
+					// Check the claimed uncompressed size against the
+					// stream's receive window before decompress allocates
+					// anything, so the window actually bounds memory use
+					// instead of being checked only after the fact.
+					stream := (*Stream)(p)
+					if !cs.reserveRecvWindow(streamIdx, int(uncompressedLen)) {
+						cs.broadcast(ErrWindowExceeded)
+						return
+					}
+
+					decoded, derr := decompress(compressed)
+					if derr != nil {
+						cs.broadcast(derr)
+						return
+					}
+
+					stream.readResp <- &readState{n: len(decoded), buf: decoded, idx: streamIdx}
+
+					readChan <- true
+					return
+				case cmdReset:
+					// notifyRead/notifyWrite record ErrStreamReset on the
+					// Stream permanently (see stream.go), rather than a
+					// best-effort send on readResp/writeStateResp that's
+					// silently dropped if nothing happens to be parked on
+					// them right now - the request's "in-flight and future
+					// Reads return ErrStreamReset" needs the former.
+					if p, ok := cs.streams.Load(streamIdx); ok {
+						s := (*Stream)(p)
+						s.notifyRead(notifyReset)
+						s.notifyWrite(notifyReset)
+					}
+
 					readChan <- true
 					return
 				default:
@@ -140,8 +329,18 @@ func (cs *connState) start() {
 				return
 			}
 
-			payload := make([]byte, streamLen)
-			_, err = io.ReadAtLeast(cs.conn, payload, streamLen)
+			// Enforce the negotiated frame-size cap; falls back to
+			// defaultMaxFrameSize before the handshake completes.
+			maxFrameSize := cs.maxFrameSize
+			if maxFrameSize == 0 {
+				maxFrameSize = defaultMaxFrameSize
+			}
+			if uint32(streamLen) > maxFrameSize {
+				cs.broadcast(ErrFrameTooLarge)
+				return
+			}
+
+			payload, err := cs.framer.ReadPayload(streamLen)
 			// Maybe we will encounter an error, but we pass it to streams
 			// Next loop when we read the header, we will have the error again, that time we will broadcast
 			rs := &readState{
@@ -152,10 +351,19 @@ func (cs *connState) start() {
 			}
 
 			if s, ok := cs.streams.Load(streamIdx); ok {
-				(*Stream)(s).readResp <- rs
+				stream := (*Stream)(s)
+				if !cs.reserveRecvWindow(streamIdx, streamLen) {
+					cs.broadcast(ErrWindowExceeded)
+					return
+				}
+				stream.readResp <- rs
 			} else {
-				buf[5], buf[6] = cmdByte, cmdClose
-				if _, err = cs.conn.Write(buf); err != nil {
+				// Unknown stream: it was already torn down on our end, so
+				// tell the peer unambiguously to forget it rather than
+				// cmdClose, which would imply there's still buffered data
+				// worth finishing a graceful read of.
+				buf[5], buf[6] = cmdByte, cmdReset
+				if err = cs.framer.WriteFrame(buf); err != nil {
 					cs.broadcast(err)
 					return
 				}
@@ -192,10 +400,11 @@ func (cs *connState) stop() {
 	cs.streams.Iterate(func(idx uint32, p unsafe.Pointer) bool {
 		s := (*Stream)(p)
 		s.closeNoInfo()
+		cs.windows.Delete(idx)
 		return true
 	})
 
-	cs.conn.Close()
+	cs.framer.Close()
 	cs.master.Delete(cs.idx)
 
 	cs.stopped = true
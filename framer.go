@@ -0,0 +1,72 @@
+package tcpmux
+
+import "io"
+
+// Framer decouples connState from any particular byte transport. The
+// default tcpFramer reads and writes directly against a net.Conn the way
+// connState always has; wsFramer (see ws_framer.go) lets the same mux
+// run over a WebSocket connection instead, so it can be tunnelled
+// through HTTP reverse proxies, cloud load balancers, and browser
+// clients.
+//
+// Not every tcpmux frame is header-plus-fixed-payload: a data frame's
+// length comes from the header, but several command frames (cmdVersion,
+// cmdWindowUpdate, cmdDataLZ4) are followed by their own variable number
+// of extra bytes. ReadHeader/ReadPayload split the two so a
+// message-oriented transport like WebSocket, which already has the
+// whole frame buffered from a single message, can serve every
+// subsequent ReadPayload out of that buffer instead of issuing more
+// network reads.
+type Framer interface {
+	// ReadHeader blocks until the next frame's 7-byte header is
+	// available.
+	ReadHeader() (header [7]byte, err error)
+
+	// ReadPayload returns the next n bytes belonging to the frame whose
+	// header was just returned by ReadHeader.
+	ReadPayload(n int) ([]byte, error)
+
+	// WriteFrame writes a complete, already-assembled frame (header plus
+	// any payload), e.g. the output of makeFrame.
+	WriteFrame(frame []byte) error
+
+	Close() error
+}
+
+// Pinger is implemented by Framers with a transport-native keepalive,
+// such as WebSocket ping frames, so connState's ping loop can use that
+// instead of writing a cmdPing frame.
+type Pinger interface {
+	Ping() error
+}
+
+// tcpFramer is the original framing: read straight off a net.Conn, one
+// io.ReadAtLeast per field. It is the default Framer used by NewMaster.
+type tcpFramer struct {
+	conn io.ReadWriteCloser
+}
+
+func newTCPFramer(conn io.ReadWriteCloser) *tcpFramer {
+	return &tcpFramer{conn: conn}
+}
+
+func (f *tcpFramer) ReadHeader() (header [7]byte, err error) {
+	_, err = io.ReadAtLeast(f.conn, header[:], 7)
+	return header, err
+}
+
+func (f *tcpFramer) ReadPayload(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadAtLeast(f.conn, buf, n)
+	return buf, err
+}
+
+func (f *tcpFramer) WriteFrame(frame []byte) error {
+	_, err := f.conn.Write(frame)
+	return err
+}
+
+func (f *tcpFramer) Close() error {
+	return f.conn.Close()
+}
+
@@ -0,0 +1,72 @@
+package tcpmux
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// Map32 is a concurrency-safe uint32 -> unsafe.Pointer map. connState
+// uses one to key streams, windows, and (on a Master) conns by their
+// wire-level uint32 index rather than by pointer identity.
+type Map32 struct {
+	mu sync.RWMutex
+	m  map[uint32]unsafe.Pointer
+}
+
+// Load returns the value stored for key, if any.
+func (m *Map32) Load(key uint32) (unsafe.Pointer, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, ok := m.m[key]
+	return p, ok
+}
+
+// Store sets the value for key, overwriting any previous value.
+func (m *Map32) Store(key uint32, value unsafe.Pointer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.m == nil {
+		m.m = make(map[uint32]unsafe.Pointer)
+	}
+	m.m[key] = value
+}
+
+// Delete removes key, if present.
+func (m *Map32) Delete(key uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.m, key)
+}
+
+// Iterate calls f for every entry. f returning false deletes that entry
+// once iteration finishes. Entries are snapshotted under the read lock
+// before f is called, so f may safely call back into this Map32 (e.g.
+// Load/Store on a different key) without deadlocking.
+func (m *Map32) Iterate(f func(key uint32, value unsafe.Pointer) bool) {
+	m.mu.RLock()
+	entries := make(map[uint32]unsafe.Pointer, len(m.m))
+	for k, v := range m.m {
+		entries[k] = v
+	}
+	m.mu.RUnlock()
+
+	var toDelete []uint32
+	for k, v := range entries {
+		if !f(k, v) {
+			toDelete = append(toDelete, k)
+		}
+	}
+
+	if len(toDelete) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	for _, k := range toDelete {
+		delete(m.m, k)
+	}
+	m.mu.Unlock()
+}
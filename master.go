@@ -0,0 +1,73 @@
+package tcpmux
+
+import (
+	"net"
+	"unsafe"
+)
+
+// MasterConfig tunes the behavior of a Master's connections. The zero
+// value is the default: defaultStreamWindow per stream, and compression
+// off.
+type MasterConfig struct {
+	// MaxStreamWindow overrides defaultStreamWindow for every Stream
+	// accepted or opened through this Master. Zero means
+	// defaultStreamWindow.
+	MaxStreamWindow uint32
+
+	// Compression enables opportunistic LZ4 compression (see
+	// compress.go) when the peer also advertises featureCompressLZ4.
+	// Off by default so users on already-encrypted or CPU-starved links
+	// aren't paying for it unasked.
+	Compression bool
+}
+
+// Master multiplexes streams over a single underlying connection.
+type Master struct {
+	conns Map32 // idx -> *connState; a Master may own more than one conn
+	idx   uint32
+
+	cs *connState
+}
+
+// NewMaster wraps conn in a Master using the default raw-TCP Framer.
+func NewMaster(conn net.Conn, cfg ...MasterConfig) *Master {
+	return newMaster(conn, newTCPFramer(conn), cfg...)
+}
+
+// NewMasterWithFramer is like NewMaster, but lets the caller supply
+// their own Framer instead of the default raw-TCP one (e.g.
+// NewWebSocketFramer), so the mux can run over WebSocket, TLS, or any
+// other transport able to move whole tcpmux frames.
+func NewMasterWithFramer(conn net.Conn, framer Framer, cfg ...MasterConfig) *Master {
+	return newMaster(conn, framer, cfg...)
+}
+
+func newMaster(conn net.Conn, framer Framer, cfg ...MasterConfig) *Master {
+	m := &Master{}
+
+	cs := &connState{
+		conn:     conn,
+		framer:   framer,
+		master:   m.conns,
+		idx:      m.idx,
+		exitRead: make(chan bool),
+	}
+
+	if len(cfg) > 0 {
+		cs.maxStreamWindow = cfg[0].MaxStreamWindow
+		cs.compressionEnabled = cfg[0].Compression
+	}
+
+	cs.newStreamCallback = func(state *readState) {
+		cs.streams.Store(state.idx, unsafe.Pointer(newStream(state.idx, cs)))
+		cs.newStreamWindowFor(state.idx)
+	}
+
+	m.conns.Store(m.idx, unsafe.Pointer(cs))
+	m.cs = cs
+	m.idx++
+
+	go cs.start()
+
+	return m
+}
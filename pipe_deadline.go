@@ -0,0 +1,93 @@
+package tcpmux
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// pipeDeadline is an abstraction for handling timeouts on a Stream, which
+// behaves like a net.Conn but has no underlying file descriptor to hang a
+// real deadline off of. It is based on the implementation used by
+// go-mplex and net.Pipe: a deadline is a channel that is closed when the
+// deadline fires, and can be swapped out wholesale by a later
+// SetDeadline call so that in-flight selects observe the new time
+// without needing to be woken up and restarted.
+type pipeDeadline struct {
+	mu     sync.Mutex // guards timer and cancel
+	timer  *time.Timer
+	cancel chan struct{} // must be non-nil
+}
+
+func makePipeDeadline() pipeDeadline {
+	return pipeDeadline{cancel: make(chan struct{})}
+}
+
+// set sets the point in time when the deadline will time out, signaled by
+// closing the channel returned by wait(). A zero t disables the deadline.
+// Once a deadline has fired, it can be refreshed by calling set again,
+// with a future t to push it out or a zero t to disable it entirely.
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+
+	// Time is zero, so there is no deadline: make sure wait() doesn't
+	// keep returning an already-fired channel forever.
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	// Time in the future: arm a timer to close cancel when it elapses.
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	// Time in the past: the deadline has already expired.
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline fires.
+func (d *pipeDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.cancel
+}
+
+func isClosedChan(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// newDeadlineExceededError builds the error a Stream's blocking Read or
+// Write returns when a deadline set via SetDeadline/SetReadDeadline/
+// SetWriteDeadline fires, matching the net.Conn contract: it's a
+// *net.OpError wrapping os.ErrDeadlineExceeded, so errors.Is(err,
+// os.ErrDeadlineExceeded) and the net.Error.Timeout() method both work.
+func newDeadlineExceededError(op string) error {
+	return &net.OpError{Op: op, Net: "tcpmux", Err: os.ErrDeadlineExceeded}
+}
@@ -0,0 +1,69 @@
+package tcpmux
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Version is the wire protocol version this build speaks. Once the
+// version/feature handshake (version.go) completes, a peer's buf[0] is
+// only required to be >= Version, not ==, so the format can grow new
+// commands/fields without a flag day.
+const Version byte = 1
+
+// cmdByte marks buf[5] as "this is a command frame, not a data frame": a
+// data frame's buf[5:7] is instead a uint16 payload length, which
+// defaultMaxFrameSize and the negotiated maxFrameSize cap keep well
+// below this value.
+const cmdByte = 0xff
+
+// Command bytes read from buf[6] when buf[5] == cmdByte. They all live
+// in this one iota block, rather than being hardcoded separately in each
+// file that adds one, so a newly added command can't silently collide
+// with an existing one in the same buf[6] namespace.
+const (
+	cmdHello byte = iota + 1
+	cmdAck
+	cmdClose
+	cmdPing
+	cmdWindowUpdate // window.go: payload is a uint32 send-window delta
+	cmdVersion      // version.go: the initiator's handshake request
+	cmdVersionAck   // version.go: the acceptor's handshake reply
+	cmdDataLZ4      // compress.go: payload is an LZ4-compressed data frame
+	cmdReset        // reset.go: abortive teardown, as opposed to cmdClose
+)
+
+// pingInterval is how often, in seconds, connState.start's keepalive
+// goroutine pings the peer and sweeps idle streams.
+const pingInterval = 30
+
+// ErrInvalidVerHdr is broadcast when a frame's header advertises a wire
+// version older than this build's floor.
+var ErrInvalidVerHdr = errors.New("tcpmux: invalid version header")
+
+// makeFrame assembles a complete command frame: buf[5] is set to
+// cmdByte, buf[6] to cmd, and payload (if any) is appended as-is, e.g.
+// cmdVersion's encoded versionHello or cmdWindowUpdate's uint32 delta.
+// Data frames don't go through this - see makeDataFrame.
+func makeFrame(idx uint32, cmd byte, payload []byte) []byte {
+	buf := make([]byte, 7+len(payload))
+	buf[0] = Version
+	binary.BigEndian.PutUint32(buf[1:5], idx)
+	buf[5] = cmdByte
+	buf[6] = cmd
+	copy(buf[7:], payload)
+	return buf
+}
+
+// makeDataFrame assembles a plain (uncompressed) data frame: buf[5:7] is
+// payload's length rather than a cmdByte/cmd pair, so connState.start's
+// "buf[5] == cmdByte" check routes it to the data path instead of the
+// command switch.
+func makeDataFrame(idx uint32, payload []byte) []byte {
+	buf := make([]byte, 7+len(payload))
+	buf[0] = Version
+	binary.BigEndian.PutUint32(buf[1:5], idx)
+	binary.BigEndian.PutUint16(buf[5:7], uint16(len(payload)))
+	copy(buf[7:], payload)
+	return buf
+}
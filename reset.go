@@ -0,0 +1,26 @@
+package tcpmux
+
+import "errors"
+
+// cmdReset (defined in protocol.go) tears a stream down abortively, as
+// opposed to cmdClose's graceful half-close: it discards any pending
+// writes and tells the peer to do the same, rather than letting it
+// finish reading whatever was already buffered. It is also what a peer
+// sends back when it gets a data frame for a stream it no longer knows
+// about, so the sender can tell "closed, but drain your buffer" apart
+// from "torn down, forget it."
+
+// ErrStreamReset is returned by Read/Write on a Stream that was reset,
+// either locally via Stream.Reset or remotely via a cmdReset frame.
+var ErrStreamReset = errors.New("tcpmux: stream reset")
+
+// Reset abortively tears down the stream: any pending write is
+// discarded, in-flight and future Reads/Writes return ErrStreamReset,
+// and the peer is told via a cmdReset frame to do the same, rather than
+// silently timing out on its end the way Close alone would leave it.
+func (s *Stream) Reset() error {
+	s.notifyRead(notifyReset)
+	s.notifyWrite(notifyReset)
+
+	return s.cs.framer.WriteFrame(makeFrame(s.idx, cmdReset, nil))
+}
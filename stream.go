@@ -0,0 +1,241 @@
+package tcpmux
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readState is what connState.start() delivers on a Stream's readResp
+// channel: either payload read off the wire for this stream, a bare
+// command byte the stream needs to react to, or a terminal error being
+// broadcast to every stream on the conn.
+type readState struct {
+	idx uint32
+	n   int
+	buf []byte
+	err error
+	cmd byte
+}
+
+// notifyCancel and notifyReset are the signals notifyRead/notifyWrite
+// wake a blocked Read/Write with. notifyCancel is a graceful local
+// teardown (nothing in connState signals it; the GC loop retires idle
+// streams with notifyReset); notifyReset is an abortive one - from Stream.Reset or an inbound
+// cmdReset - that must surface ErrStreamReset specifically rather than
+// whatever notifyCancel yields.
+const (
+	notifyCancel = iota + 1
+	notifyReset
+)
+
+// Stream is one multiplexed logical connection carried over a shared
+// connState. It behaves like a net.Conn: Read/Write block the caller and
+// honor SetDeadline, and Close/Reset tear this stream down without
+// touching any other stream sharing the same conn.
+type Stream struct {
+	idx uint32
+	cs  *connState
+
+	readResp       chan *readState
+	writeStateResp chan byte
+
+	readDeadline  pipeDeadline
+	writeDeadline pipeDeadline
+
+	closed     atomic.Value // bool
+	lastActive int64        // UnixNano; touched by Read/Write, read by the GC loop
+	timeout    int64        // seconds; the GC loop resets the stream if this is 0 or it has been idle longer
+
+	// teardownCh/teardownErr/teardownOnce record a local or remote
+	// teardown once, permanently: Read/Write check teardownErr before
+	// ever blocking, so a reset that arrives with nothing parked on
+	// readResp still reliably fails every Read/Write that follows,
+	// rather than depending on a channel send landing while someone
+	// happens to be listening.
+	teardownCh   chan struct{}
+	teardownErr  atomic.Value // error
+	teardownOnce sync.Once
+
+	pending []byte // unconsumed tail of the last readState.buf
+}
+
+func newStream(idx uint32, cs *connState) *Stream {
+	s := &Stream{
+		idx:            idx,
+		cs:             cs,
+		readResp:       make(chan *readState, 1),
+		writeStateResp: make(chan byte, 1),
+		readDeadline:   makePipeDeadline(),
+		writeDeadline:  makePipeDeadline(),
+		teardownCh:     make(chan struct{}),
+		lastActive:     time.Now().UnixNano(),
+	}
+	s.closed.Store(false)
+	return s
+}
+
+// signalErr is the error notifyRead/notifyWrite record for a given
+// signal: notifyReset maps to ErrStreamReset specifically, anything else
+// (just notifyCancel today) to the generic closed-pipe error net.Pipe
+// itself uses for a locally torn down end.
+func signalErr(signal int) error {
+	if signal == notifyReset {
+		return ErrStreamReset
+	}
+	return io.ErrClosedPipe
+}
+
+func (s *Stream) setTeardown(err error) {
+	s.teardownOnce.Do(func() {
+		s.teardownErr.Store(err)
+		close(s.teardownCh)
+	})
+}
+
+// notifyRead and notifyWrite both record the same permanent teardown
+// state (see teardownErr above); the two separate entry points exist so
+// the GC loop and Reset can signal "reads should stop" and "writes
+// should stop" as distinct calls, matching how the rest of connState
+// always fires them in a pair.
+func (s *Stream) notifyRead(signal int)  { s.setTeardown(signalErr(signal)) }
+func (s *Stream) notifyWrite(signal int) { s.setTeardown(signalErr(signal)) }
+
+// closeNoInfo is called by connState.stop() when the whole conn is going
+// away: there's no point telling the peer about each stream individually
+// since the conn itself is being torn down.
+func (s *Stream) closeNoInfo() {
+	s.closed.Store(true)
+	s.setTeardown(io.ErrClosedPipe)
+}
+
+// Close half-closes the stream: no more data will be sent, but whatever
+// the peer already has buffered for us is still worth reading. Contrast
+// Reset, which discards everything and fails future Reads outright.
+func (s *Stream) Close() error {
+	s.closed.Store(true)
+	return s.cs.framer.WriteFrame(makeFrame(s.idx, cmdClose, nil))
+}
+
+// Read implements net.Conn's Read. It blocks until data arrives for this
+// stream, the stream is closed/reset (locally or by the peer), or
+// readDeadline fires.
+func (s *Stream) Read(p []byte) (int, error) {
+	if err, ok := s.teardownErr.Load().(error); ok && (err == ErrStreamReset || len(s.pending) == 0) {
+		return 0, err
+	}
+	if isClosedChan(s.readDeadline.wait()) {
+		return 0, newDeadlineExceededError("read")
+	}
+
+	for len(s.pending) == 0 {
+		select {
+		case rs := <-s.readResp:
+			if rs.err != nil {
+				return 0, rs.err
+			}
+			if rs.cmd == cmdClose {
+				return 0, io.EOF
+			}
+			if len(rs.buf) == 0 {
+				continue
+			}
+			s.pending = rs.buf
+		case <-s.teardownCh:
+			return 0, s.teardownErr.Load().(error)
+		case <-s.readDeadline.wait():
+			return 0, newDeadlineExceededError("read")
+		}
+	}
+
+	// A reset that raced with a frame arriving still fails the Read.
+	if err, ok := s.teardownErr.Load().(error); ok && err == ErrStreamReset {
+		return 0, err
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	s.lastActive = time.Now().UnixNano()
+
+	// Only now that the caller has actually consumed these bytes do we
+	// tell the peer it can have the window back - not when the frame
+	// arrived off the wire - so a Read the caller never calls really
+	// does backpressure the sender instead of the window refilling
+	// itself behind its back.
+	s.cs.drainRecvWindow(s.idx, n)
+
+	return n, nil
+}
+
+// Write implements net.Conn's Write: the whole of p is sent as one
+// frame - LZ4-compressed if both peers negotiated it and compressing
+// helps, otherwise plain - blocking until the peer's last
+// cmdWindowUpdate leaves enough send window for it.
+func (s *Stream) Write(p []byte) (int, error) {
+	if err, ok := s.teardownErr.Load().(error); ok {
+		return 0, err
+	}
+	if s.closed.Load().(bool) {
+		return 0, io.ErrClosedPipe
+	}
+	if isClosedChan(s.writeDeadline.wait()) {
+		return 0, newDeadlineExceededError("write")
+	}
+
+	reserved, timedOut := s.cs.reserveSendWindow(s.idx, len(p), s.teardownCh, s.writeDeadline.wait())
+	if !reserved {
+		if timedOut {
+			return 0, newDeadlineExceededError("write")
+		}
+		return 0, s.teardownErr.Load().(error)
+	}
+
+	if err := s.cs.framer.WriteFrame(s.encodeFrame(p)); err != nil {
+		return 0, err
+	}
+
+	s.lastActive = time.Now().UnixNano()
+	return len(p), nil
+}
+
+// encodeFrame picks LZ4-compressed framing for p when both peers
+// negotiated featureCompressLZ4 and compressing is worth it (see
+// compress.go's maybeCompress), falling back to a plain data frame
+// otherwise. A cmdDataLZ4 frame's payload is a 4-byte compressed length
+// followed by the compressed bytes themselves (which start with their
+// own 4-byte uncompressed-length prefix) - see connState.start's
+// cmdDataLZ4 case for the reader side.
+func (s *Stream) encodeFrame(p []byte) []byte {
+	if s.cs.handshakeDone && s.cs.featureFlags&featureCompressLZ4 != 0 {
+		if compressed, ok := maybeCompress(p); ok {
+			lenPrefix := make([]byte, 4)
+			binary.BigEndian.PutUint32(lenPrefix, uint32(len(compressed)))
+			return makeFrame(s.idx, cmdDataLZ4, append(lenPrefix, compressed...))
+		}
+	}
+	return makeDataFrame(s.idx, p)
+}
+
+// SetDeadline sets both the read and write deadlines, as net.Conn
+// requires. A zero time.Time disables them (no deadline).
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future Read calls. A zero
+// time.Time disables it; a past time fails the next Read with a
+// *net.OpError wrapping os.ErrDeadlineExceeded.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline is SetReadDeadline's write-side counterpart.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
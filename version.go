@@ -0,0 +1,97 @@
+package tcpmux
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// cmdVersion (defined in protocol.go, alongside every other command
+// byte) is sent by the initiator immediately after dialing, before any
+// cmdHello, carrying {uint16 maxVersion, uint16 flags, uint32
+// maxFrameSize} in its payload. The acceptor replies with cmdVersionAck
+// and the minimum-of-both values; mirroring p9p's Tversion/Rversion
+// split keeps the exchange from looping forever, since only a cmdVersion
+// (the request) gets a reply, never a cmdVersionAck (the reply) itself.
+// No stream may be opened or accepted until this exchange completes.
+
+// versionPayloadLen is the fixed size of a cmdVersion payload: two
+// uint16s and a uint32.
+const versionPayloadLen = 2 + 2 + 4
+
+// Feature flags negotiated during the version handshake. A flag only
+// takes effect when both peers advertise it; the negotiated set is the
+// bitwise AND of the initiator's and the acceptor's flags.
+const (
+	featureWindowUpdate uint16 = 1 << iota
+	featureCompressLZ4
+)
+
+// defaultMaxFrameSize bounds the length field of a data frame until the
+// handshake negotiates something smaller.
+const defaultMaxFrameSize uint32 = 1 << 20
+
+// ErrHandshakeRequired is broadcast if a peer tries to open or use a
+// stream before the version/feature handshake has completed.
+var ErrHandshakeRequired = errors.New("tcpmux: stream used before version handshake completed")
+
+// ErrFrameTooLarge is broadcast when a data frame's length exceeds the
+// negotiated maxFrameSize, making the cap from the version handshake
+// actually mean something instead of just being recorded and ignored.
+var ErrFrameTooLarge = errors.New("tcpmux: data frame exceeds negotiated maxFrameSize")
+
+// versionHello is the decoded form of a cmdVersion payload.
+type versionHello struct {
+	maxVersion   uint16
+	flags        uint16
+	maxFrameSize uint32
+}
+
+func decodeVersionHello(payload []byte) versionHello {
+	return versionHello{
+		maxVersion:   binary.BigEndian.Uint16(payload[0:2]),
+		flags:        binary.BigEndian.Uint16(payload[2:4]),
+		maxFrameSize: binary.BigEndian.Uint32(payload[4:8]),
+	}
+}
+
+func (v versionHello) encode() []byte {
+	buf := make([]byte, versionPayloadLen)
+	binary.BigEndian.PutUint16(buf[0:2], v.maxVersion)
+	binary.BigEndian.PutUint16(buf[2:4], v.flags)
+	binary.BigEndian.PutUint32(buf[4:8], v.maxFrameSize)
+	return buf
+}
+
+// negotiateVersion folds a peer's versionHello into cs's negotiated
+// state, settling on the minimum-of-both for version/frame size and the
+// intersection of feature flags. Shared by both the cmdVersion and
+// cmdVersionAck cases since the arithmetic is identical either way.
+func (cs *connState) negotiateVersion(remote versionHello) {
+	local := versionHello{maxVersion: Version, flags: featureWindowUpdate, maxFrameSize: defaultMaxFrameSize}
+	if cs.compressionEnabled {
+		local.flags |= featureCompressLZ4
+	}
+
+	cs.Lock()
+	cs.negotiatedVersion = min16(remote.maxVersion, local.maxVersion)
+	cs.featureFlags = remote.flags & local.flags
+	cs.maxFrameSize = min32(remote.maxFrameSize, local.maxFrameSize)
+	cs.handshakeDone = true
+	cs.Unlock()
+}
+
+// min16 returns the lesser of a and b, used to settle on the lower of the
+// two peers' proposed values during negotiation.
+func min16(a, b uint16) uint16 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func min32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
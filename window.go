@@ -0,0 +1,197 @@
+package tcpmux
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"unsafe"
+)
+
+// defaultStreamWindow is the initial receive window granted to a new
+// Stream when MasterConfig.MaxStreamWindow is left at zero, mirroring
+// yamux's default of 256KiB. Raise it via MasterConfig for high
+// bandwidth-delay-product links.
+const defaultStreamWindow uint32 = 256 * 1024
+
+// windowUpdateFraction is how much of the window must be drained before
+// we bother telling the peer about the reclaimed credit: keeps window
+// updates rare instead of one per frame.
+const windowUpdateFraction = 2 // i.e. half the window
+
+// ErrWindowExceeded is broadcast when a peer writes more data to a stream
+// than the window it was last granted. That can only happen if the peer
+// is buggy or malicious, so it is treated as a fatal protocol violation
+// rather than silently tolerated.
+var ErrWindowExceeded = errors.New("tcpmux: stream data exceeds advertised window")
+
+// streamWindow is the credit-based flow control state for one stream.
+// recv bounds how much more the peer may send us before it's a protocol
+// violation; send bounds how much more we may send the peer before its
+// next cmdWindowUpdate. connState keeps one of these per stream in its
+// windows map, keyed by stream idx.
+//
+// recv is only ever reserved at frame arrival (reserveRecv) and only
+// ever replenished once Stream.Read actually hands the bytes to the
+// caller (drainRecv) - never both in the same call - so a stuck reader
+// genuinely exhausts the window instead of it refilling itself the
+// instant a frame lands on the wire.
+type streamWindow struct {
+	mu      sync.Mutex
+	max     uint32
+	recv    uint32
+	drained uint32 // bytes consumed by Read since the last cmdWindowUpdate we sent
+
+	send      uint32
+	sendReady chan struct{} // closed and replaced by grantSend, wakes anyone parked in reserveSendWindow
+}
+
+func newStreamWindow(max uint32) *streamWindow {
+	if max == 0 {
+		max = defaultStreamWindow
+	}
+
+	return &streamWindow{max: max, recv: max, send: max, sendReady: make(chan struct{})}
+}
+
+// reserveRecv accounts for n bytes of an arriving frame against the
+// receive window. ok is false if the peer sent more than it was ever
+// granted, which the caller should treat as ErrWindowExceeded.
+func (w *streamWindow) reserveRecv(n uint32) (ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if n > w.recv {
+		return false
+	}
+	w.recv -= n
+	return true
+}
+
+// drainRecv records that the application has now actually consumed n
+// bytes (via Stream.Read). Once the running total crosses
+// windowUpdateFraction of the window, it returns the delta a
+// cmdWindowUpdate frame should grant back to the peer and resets the
+// counter.
+func (w *streamWindow) drainRecv(n uint32) (delta uint32, emit bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.drained += n
+	if w.drained < w.max/windowUpdateFraction {
+		return 0, false
+	}
+
+	delta = w.drained
+	w.recv += delta
+	w.drained = 0
+	return delta, true
+}
+
+// grantSend credits delta more bytes of send window after a
+// cmdWindowUpdate arrives from the peer, and wakes any Stream.Write
+// blocked in reserveSendWindow.
+func (w *streamWindow) grantSend(delta uint32) {
+	w.mu.Lock()
+	w.send += delta
+	ready := w.sendReady
+	w.sendReady = make(chan struct{})
+	w.mu.Unlock()
+
+	close(ready)
+}
+
+// tryReserveSend attempts to take n bytes of send window without
+// blocking. If there isn't enough, it returns the channel that closes
+// the next time grantSend credits more.
+func (w *streamWindow) tryReserveSend(n uint32) (ok bool, ready chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.send >= n {
+		w.send -= n
+		return true, nil
+	}
+	return false, w.sendReady
+}
+
+// reserveRecvWindow looks up idx's streamWindow and reserves n bytes
+// against it for a frame that just arrived off the wire. Reports
+// whether the frame was within the advertised window; false means the
+// peer violated flow control. A stream with no tracked window (e.g.
+// flow control isn't in use) always succeeds.
+func (cs *connState) reserveRecvWindow(idx uint32, n int) bool {
+	p, ok := cs.windows.Load(idx)
+	if !ok {
+		return true
+	}
+
+	return (*streamWindow)(p).reserveRecv(uint32(n))
+}
+
+// drainRecvWindow tells idx's streamWindow that the application consumed
+// n more bytes, emitting a cmdWindowUpdate frame once that crosses the
+// threshold. Called from Stream.Read, not from the network read loop,
+// so the window actually backpressures a reader that never calls Read.
+func (cs *connState) drainRecvWindow(idx uint32, n int) {
+	p, ok := cs.windows.Load(idx)
+	if !ok {
+		return
+	}
+
+	delta, emit := (*streamWindow)(p).drainRecv(uint32(n))
+	if !emit {
+		return
+	}
+
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, delta)
+	cs.framer.WriteFrame(makeFrame(idx, cmdWindowUpdate, payload))
+}
+
+// grantSendWindow credits a cmdWindowUpdate's delta to idx's streamWindow.
+func (cs *connState) grantSendWindow(idx uint32, delta uint32) {
+	if p, ok := cs.windows.Load(idx); ok {
+		(*streamWindow)(p).grantSend(delta)
+	}
+}
+
+// reserveSendWindow reserves n bytes of idx's send window for an
+// outgoing write, blocking until the peer grants enough via
+// cmdWindowUpdate, abort fires (stream torn down), or deadline fires. A
+// stream with no tracked window always succeeds immediately. timedOut is
+// only meaningful when reserved is false.
+func (cs *connState) reserveSendWindow(idx uint32, n int, abort, deadline <-chan struct{}) (reserved, timedOut bool) {
+	p, ok := cs.windows.Load(idx)
+	if !ok {
+		return true, false
+	}
+	w := (*streamWindow)(p)
+
+	for {
+		if ok, ready := w.tryReserveSend(uint32(n)); ok {
+			return true, false
+		} else {
+			select {
+			case <-ready:
+				// Either we got more credit, or another waiter drained it
+				// first - loop back and retry tryReserveSend either way.
+			case <-abort:
+				return false, false
+			case <-deadline:
+				return false, true
+			}
+		}
+	}
+}
+
+// newStreamWindowFor registers a fresh streamWindow for idx, sized by
+// MasterConfig.MaxStreamWindow (or defaultStreamWindow if that was left
+// at zero). Called once per stream, alongside newStreamCallback. No
+// window is registered unless featureWindowUpdate was negotiated, so such
+// a stream runs without flow control.
+func (cs *connState) newStreamWindowFor(idx uint32) {
+	if cs.featureFlags&featureWindowUpdate == 0 {
+		return
+	}
+	cs.windows.Store(idx, unsafe.Pointer(newStreamWindow(cs.maxStreamWindow)))
+}
@@ -0,0 +1,79 @@
+package tcpmux
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsFramer carries the mux over a WebSocket connection: each binary
+// message holds exactly one tcpmux frame, header plus however much
+// payload that frame needs, the way minio's grid transport piggybacks
+// RPC frames on WS messages. Because a whole frame always arrives in one
+// message, ReadPayload never touches the network: it just slices
+// further into the message ReadHeader already read.
+type wsFramer struct {
+	conn *websocket.Conn
+
+	pending []byte // bytes left in the current message after ReadHeader
+
+	// writeMu serializes WriteFrame/Ping: unlike net.Conn, gorilla's
+	// websocket.Conn only supports one concurrent writer, and connState
+	// writes from both the read loop and the ping daemon goroutine.
+	writeMu sync.Mutex
+}
+
+// NewWebSocketFramer adapts an already-established WebSocket connection
+// into a Framer so it can be passed to NewMasterWithFramer.
+func NewWebSocketFramer(conn *websocket.Conn) Framer {
+	return &wsFramer{conn: conn}
+}
+
+func (f *wsFramer) ReadHeader() (header [7]byte, err error) {
+	msgType, msg, err := f.conn.ReadMessage()
+	if err != nil {
+		return header, err
+	}
+
+	if msgType != websocket.BinaryMessage {
+		return header, errors.New("tcpmux: wsFramer received a non-binary message")
+	}
+
+	if len(msg) < 7 {
+		return header, io.ErrUnexpectedEOF
+	}
+
+	copy(header[:], msg[:7])
+	f.pending = msg[7:]
+	return header, nil
+}
+
+func (f *wsFramer) ReadPayload(n int) ([]byte, error) {
+	if len(f.pending) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	payload := f.pending[:n]
+	f.pending = f.pending[n:]
+	return payload, nil
+}
+
+func (f *wsFramer) WriteFrame(frame []byte) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+func (f *wsFramer) Ping() error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (f *wsFramer) Close() error {
+	return f.conn.Close()
+}